@@ -0,0 +1,173 @@
+package nwk
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+)
+
+// DOTOptions controls the rendering performed by (*Node).DOT.
+type DOTOptions struct {
+	// ShapeFor and ColorFor, when set, are consulted for every node to
+	// pick its Graphviz shape and fill color; a zero return value leaves
+	// the corresponding attribute unset, so Graphviz falls back to its
+	// own default.
+	ShapeFor func(n *Node) string
+	ColorFor func(n *Node) string
+	// ShowLengths prints branch lengths as edge labels.
+	ShowLengths bool
+	// ShowInternalLabels prints the labels of internal nodes; leaf
+	// labels are always printed.
+	ShowInternalLabels bool
+	// LeftToRight lays the graph out left to right instead of top to
+	// bottom.
+	LeftToRight bool
+}
+
+// DOT renders the subtree rooted on its receiver as a Graphviz digraph.
+func (n *Node) DOT(w io.Writer, opts *DOTOptions) error {
+	if opts == nil {
+		opts = new(DOTOptions)
+	}
+	fmt.Fprintln(w, "digraph nwk {")
+	if opts.LeftToRight {
+		fmt.Fprintln(w, "\trankdir=LR;")
+	}
+	err := n.Walk(context.Background(), WalkHandler{
+		PreNode: func(path Path) error {
+			v := path.Node()
+			name := "n" + strconv.Itoa(v.Id)
+			label := v.Label
+			if v.Child != nil && !opts.ShowInternalLabels {
+				label = ""
+			}
+			fmt.Fprintf(w, "\t%s [label=%q", name, label)
+			if opts.ShapeFor != nil {
+				if shape := opts.ShapeFor(v); shape != "" {
+					fmt.Fprintf(w, ",shape=%q", shape)
+				}
+			}
+			if opts.ColorFor != nil {
+				if color := opts.ColorFor(v); color != "" {
+					fmt.Fprintf(w, ",style=filled,fillcolor=%q", color)
+				}
+			}
+			fmt.Fprintln(w, "];")
+			return nil
+		},
+		Edge: func(path Path) error {
+			child := path.Node()
+			parent := path[len(path)-2]
+			fmt.Fprintf(w, "\tn%d -> n%d", parent.Id, child.Id)
+			if opts.ShowLengths && child.HasLength {
+				fmt.Fprintf(w, " [label=%q]", strconv.FormatFloat(child.Length, 'g', 3, 64))
+			}
+			fmt.Fprintln(w, ";")
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(w, "}")
+	return nil
+}
+
+// RenderSVG writes an SVG rendering of the subtree rooted on its receiver
+// to w. It shells out to the "dot" binary when available, and falls back
+// to a simple, pure-Go layered layout otherwise.
+func (n *Node) RenderSVG(w io.Writer) error {
+	var buf bytes.Buffer
+	if err := n.DOT(&buf, nil); err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("dot"); err == nil {
+		cmd := exec.Command("dot", "-Tsvg")
+		cmd.Stdin = &buf
+		cmd.Stdout = w
+		return cmd.Run()
+	}
+	return n.renderSVGFallback(w)
+}
+
+// renderSVGFallback lays the subtree out in horizontal layers, one per
+// depth, without calling out to Graphviz. It is deliberately simple: it
+// exists so RenderSVG keeps working when "dot" isn't installed, not to
+// compete with it on layout quality.
+func (n *Node) renderSVGFallback(w io.Writer) error {
+	const (
+		xStep = 80
+		yStep = 40
+		rad   = 4
+	)
+	type point struct {
+		x, y  int
+		label string
+	}
+	var nodes []point
+	var edges [][2]int
+	index := make(map[int]int)
+	leafX := 0
+	err := n.Walk(context.Background(), WalkHandler{
+		Leaf: func(path Path) error {
+			v := path.Node()
+			index[v.Id] = len(nodes)
+			nodes = append(nodes, point{leafX * xStep, path.Depth() * yStep, v.Label})
+			leafX++
+			return nil
+		},
+		PostNode: func(path Path) error {
+			v := path.Node()
+			if v.Child == nil {
+				return nil
+			}
+			sum, cnt := 0, 0
+			for c := v.Child; c != nil; c = c.Sib {
+				sum += nodes[index[c.Id]].x
+				cnt++
+			}
+			index[v.Id] = len(nodes)
+			nodes = append(nodes, point{sum / cnt, path.Depth() * yStep, v.Label})
+			return nil
+		},
+		Edge: func(path Path) error {
+			child := path.Node()
+			parent := path[len(path)-2]
+			edges = append(edges, [2]int{parent.Id, child.Id})
+			return nil
+		},
+	})
+	if err != nil {
+		return err
+	}
+	width, height := 0, 0
+	for _, p := range nodes {
+		if p.x > width {
+			width = p.x
+		}
+		if p.y > height {
+			height = p.y
+		}
+	}
+	fmt.Fprintf(w, "<svg xmlns=\"http://www.w3.org/2000/svg\" "+
+		"viewBox=\"-20 -20 %d %d\">\n", width+40, height+40)
+	for _, e := range edges {
+		p, c := nodes[index[e[0]]], nodes[index[e[1]]]
+		fmt.Fprintf(w, "<line x1=\"%d\" y1=\"%d\" x2=\"%d\" y2=\"%d\" stroke=\"black\"/>\n",
+			p.x, p.y, c.x, c.y)
+	}
+	for _, p := range nodes {
+		fmt.Fprintf(w, "<circle cx=\"%d\" cy=\"%d\" r=\"%d\"/>\n", p.x, p.y, rad)
+		if p.label != "" {
+			fmt.Fprintf(w, "<text x=\"%d\" y=\"%d\">", p.x+rad+2, p.y+rad)
+			xml.EscapeText(w, []byte(p.label))
+			fmt.Fprintln(w, "</text>")
+		}
+	}
+	fmt.Fprintln(w, "</svg>")
+	return nil
+}
@@ -4,6 +4,8 @@ package nwk
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
@@ -11,6 +13,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"text/scanner"
 )
 
@@ -21,16 +24,74 @@ type Node struct {
 	Label              string
 	Length             float64
 	HasLength          bool
-	marked             bool
+	// Meta holds the tag/value pairs of an NHX annotation
+	// ([&&NHX:tag=value:...]) attached to this node or its incoming
+	// branch. It is nil if the node carries no NHX annotation.
+	Meta map[string]string
+	// Comment holds the text of a bracketed comment that isn't an NHX
+	// annotation, verbatim and without its brackets, so it round-trips
+	// through String.
+	Comment string
+	marked  bool
 }
 
 // Scanner scans an input file one tree at a time.
 type Scanner struct {
 	r    *bufio.Reader
 	text string
+	err  error
+	// AllowNHX controls how the scanner reacts to an NHX annotation
+	// ([&&NHX:...]) in the input. NewScanner sets it to true; callers
+	// that only expect plain Newick can set it to false to get an error
+	// via Err instead of the annotation being parsed.
+	AllowNHX bool
 }
 
-var nodeId = 1
+// A Path records the chain of nodes from the root to the node currently
+// visited by Walk; the last element is the current node. Callbacks can
+// inspect its length for depth-aware processing.
+type Path []*Node
+
+// Node returns the current node, the last element of the path.
+func (p Path) Node() *Node {
+	return p[len(p)-1]
+}
+
+// Depth returns the number of edges between the root and the current node.
+func (p Path) Depth() int {
+	return len(p) - 1
+}
+
+// SkipSubtree is returned by a WalkHandler callback to prune a subtree
+// without aborting the rest of the traversal: from PreNode, it skips the
+// current node's children as well as its own Leaf and PostNode; from Edge, it skips just that child (and
+// everything under it) without visiting its PreNode/Leaf/PostNode at
+// all. Returned from Leaf or PostNode, where there's nothing left to
+// prune, it's equivalent to nil. Any other non-nil error aborts the
+// traversal and is returned by Walk.
+var SkipSubtree = errors.New("skip subtree")
+
+// A WalkHandler bundles the callbacks invoked by Walk during a single
+// depth-first traversal of a tree. Any callback may be left nil, in which
+// case it is skipped. See SkipSubtree for how each callback can use it to
+// prune.
+//
+// Walk reuses the backing array of the Path it passes to these callbacks
+// from one node to the next, so a callback that needs to keep a Path
+// around past its own call must copy it first.
+type WalkHandler struct {
+	// PreNode is called when a node is first reached, before its children.
+	PreNode func(path Path) error
+	// PostNode is called after a node's children have all been visited.
+	PostNode func(path Path) error
+	// Leaf is called for nodes without children, after PreNode.
+	Leaf func(path Path) error
+	// Edge is called once per child, right before it is visited; path is
+	// the path to the child, so the parent is path[len(path)-2].
+	Edge func(path Path) error
+}
+
+var nodeId int64 = 1
 
 // Method AddChild adds a child node to a Node.  Inside
 func (n *Node) AddChild(v *Node) {
@@ -98,34 +159,103 @@ func (v *Node) UpDistance(w *Node) float64 {
 	return s
 }
 
+// SetMeta sets an NHX tag on a node, creating its Meta map if necessary.
+func (v *Node) SetMeta(key, val string) {
+	if v.Meta == nil {
+		v.Meta = make(map[string]string)
+	}
+	v.Meta[key] = val
+}
+
+// GetMeta returns the value of an NHX tag on a node, and whether it was
+// present.
+func (v *Node) GetMeta(key string) (string, bool) {
+	val, ok := v.Meta[key]
+	return val, ok
+}
+
 //  The method UniformLabels labels all nodes in the subtree with  a prefix followed by the node ID.
 func (v *Node) UniformLabels(pre string) {
-	label(v, pre)
+	v.Walk(context.Background(), WalkHandler{
+		PostNode: func(path Path) error {
+			n := path.Node()
+			n.Label = pre + strconv.Itoa(n.Id)
+			return nil
+		},
+	})
+}
+
+// Walk traverses the subtree rooted on its receiver in depth-first order,
+// invoking the callbacks in h at each node. It propagates the first
+// non-nil error returned by a callback, except SkipSubtree (see
+// SkipSubtree for how it prunes without aborting the walk). Walk checks
+// ctx.Done() between nodes and returns ctx.Err() once it fires.
+func (n *Node) Walk(ctx context.Context, h WalkHandler) error {
+	return walk(ctx, Path{n}, h)
 }
 
 // String turns a tree into its Newick string.
 func (n *Node) String() string {
 	w := new(bytes.Buffer)
-	writeTree(n, w)
+	n.Walk(context.Background(), WalkHandler{
+		PreNode: func(path Path) error {
+			if path.Node().Child != nil {
+				fmt.Fprint(w, "(")
+			}
+			return nil
+		},
+		PostNode: func(path Path) error {
+			v := path.Node()
+			if v.Child != nil {
+				fmt.Fprint(w, ")")
+			}
+			printLabel(w, v)
+			return nil
+		},
+		Edge: func(path Path) error {
+			child := path.Node()
+			parent := path[len(path)-2]
+			if child.Id != parent.Child.Id {
+				fmt.Fprint(w, ",")
+			}
+			return nil
+		},
+	})
+	fmt.Fprint(w, ";")
 	return w.String()
 }
 
 //  Method Print prints nodes indented to form a tree. The code is  taken from Sedgewick, R. (1998). Algorithms in C, Parts 1-4. 3rd  Edition, p. 237.
 func (v *Node) Print() string {
-	h := 0
-	var b []byte
-	buf := bytes.NewBuffer(b)
-	show(v, h, buf)
+	buf := new(bytes.Buffer)
+	v.Walk(context.Background(), WalkHandler{
+		PreNode: func(path Path) error {
+			n := path.Node()
+			l := n.Label
+			if len(l) == 0 {
+				l = "*"
+			}
+			for i := 0; i < path.Depth(); i++ {
+				fmt.Fprint(buf, "   ")
+			}
+			fmt.Fprintf(buf, "%s\n", l)
+			return nil
+		},
+	})
 	return buf.String()
 }
 
 //  Method Key returns a string key for the nodes rooted on its  receiver. The key consists of the sorted, concatenated labels of the  nodes in the subtree. The labeles are joined on a separator supplied  by the caller.
 func (v *Node) Key(sep string) string {
 	labels := make(map[string]bool)
-	if v.Label != "" {
-		labels[v.Label] = true
-	}
-	collectLabels(v.Child, labels)
+	v.Walk(context.Background(), WalkHandler{
+		PreNode: func(path Path) error {
+			if l := path.Node().Label; l != "" {
+				labels[l] = true
+			}
+			return nil
+		},
+	})
 	var keys []string
 	for k, _ := range labels {
 		keys = append(keys, k)
@@ -145,13 +275,41 @@ func (s *Scanner) Scan() bool {
 	return false
 }
 
-// The method Tree returns the most recent tree scanned.
+// Err returns the first error encountered while parsing a tree with Tree,
+// if any.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// The method Tree returns the most recent tree scanned, or nil if the
+// tree couldn't be parsed; check Err in that case.
 func (s *Scanner) Tree() *Node {
+	root, err := parseTree(s.Text(), s.AllowNHX)
+	s.err = err
+	return root
+}
+
+// A ParseError reports a malformed tree, with the line and column at
+// which the scanner gave up.
+type ParseError struct {
+	Line, Col int
+	Msg       string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%d:%d: %s", e.Line, e.Col, e.Msg)
+}
+
+// parseTree parses a single semicolon-terminated Newick tree. It backs
+// both Scanner.Tree and Reader.Read.
+func parseTree(text string, allowNHX bool) (*Node, error) {
 	var root *Node
 	var tokens []string
-	tree := s.Text()
-	tree = strings.ReplaceAll(tree, "[", "/*")
-	tree = strings.ReplaceAll(tree, "]", "*/")
+	var positions []scanner.Position
+	tree, err := extractBracketed(text, allowNHX)
+	if err != nil {
+		return nil, err
+	}
 	tree = strings.ReplaceAll(tree, "'", "\"")
 	tree = strings.ReplaceAll(tree, "\"\"", "'")
 	c1 := []rune(tree)
@@ -172,22 +330,26 @@ func (s *Scanner) Tree() *Node {
 	var tsc scanner.Scanner
 	tsc.Init(strings.NewReader(tree))
 	for t := tsc.Scan(); t != scanner.EOF; t = tsc.Scan() {
-		text := tsc.TokenText()
-		if text[0] == '"' {
+		pos := tsc.Position
+		tokText := tsc.TokenText()
+		if tokText[0] == '"' {
 			var err error
-			text, err = strconv.Unquote(text)
+			tokText, err = strconv.Unquote(tokText)
 			if err != nil {
-				log.Fatalf("couldn't unquote %q\n", text)
+				return nil, &ParseError{pos.Line, pos.Column,
+					fmt.Sprintf("couldn't unquote %q", tokText)}
 			}
 		} else {
-			text = strings.ReplaceAll(text, "_", " ")
+			tokText = strings.ReplaceAll(tokText, "_", " ")
 		}
-		tokens = append(tokens, text)
+		tokens = append(tokens, tokText)
+		positions = append(positions, pos)
 	}
 	i := 0
 	v := root
 	for i < len(tokens) {
 		t := tokens[i]
+		pos := positions[i]
 		if t == "(" {
 			if v == nil {
 				v = NewNode()
@@ -207,21 +369,30 @@ func (s *Scanner) Tree() *Node {
 		if t[0] == ':' {
 			l, err := strconv.ParseFloat(t[1:], 64)
 			if err != nil {
-				log.Fatalf("didn't understand %q\n", t[1:])
+				return nil, &ParseError{pos.Line, pos.Column,
+					fmt.Sprintf("didn't understand branch length %q", t[1:])}
 			}
 			v.Length = l
 			v.HasLength = true
 		}
+		if t[0] == annoMarker {
+			raw, err := base64.StdEncoding.DecodeString(t[1:])
+			if err != nil {
+				return nil, &ParseError{pos.Line, pos.Column,
+					fmt.Sprintf("couldn't decode annotation %q", t)}
+			}
+			applyAnnotation(v, string(raw))
+		}
 		if t == ";" {
 			break
 		}
-		if strings.IndexAny(t[:1], ")(,:;") == -1 {
+		if t[0] != annoMarker && strings.IndexAny(t[:1], ")(,:;") == -1 {
 			v.Label = t
 		}
 		i++
 	}
 	root = v
-	return root
+	return root, nil
 }
 
 // The method Text returns the text scanned most recently.
@@ -232,8 +403,7 @@ func (s *Scanner) Text() string {
 // NewNode returns a new node with a unique Id.
 func NewNode() *Node {
 	n := new(Node)
-	n.Id = nodeId
-	nodeId++
+	n.Id = int(atomic.AddInt64(&nodeId, 1) - 1)
 	return n
 }
 func clearPath(v *Node) {
@@ -248,33 +418,112 @@ func markPath(v *Node) {
 		v = v.Parent
 	}
 }
-func label(v *Node, pre string) {
-	if v == nil {
-		return
+
+// annoMarker tags a base64-encoded bracketed annotation ([&&NHX:...] or a
+// plain comment) once it has been lifted out of the tree text and quoted,
+// so the token loop in parseTree can tell it apart from an ordinary quoted
+// label.
+const annoMarker = '\x01'
+
+// extractBracketed replaces every bracketed comment in tree with a quoted,
+// base64-encoded placeholder, so that later stages (the branch-length
+// quoting pass and the Newick tokenizer) don't choke on characters such as
+// ':' that are common in NHX annotations. It returns an error if it finds
+// an NHX annotation and allowNHX is false.
+func extractBracketed(tree string, allowNHX bool) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(tree); {
+		if tree[i] != '[' {
+			b.WriteByte(tree[i])
+			i++
+			continue
+		}
+		j := strings.IndexByte(tree[i:], ']')
+		if j == -1 {
+			b.WriteByte(tree[i])
+			i++
+			continue
+		}
+		inner := tree[i+1 : i+j]
+		if !allowNHX && strings.HasPrefix(inner, "&&NHX:") {
+			return "", fmt.Errorf("unexpected NHX annotation %q", "["+inner+"]")
+		}
+		b.WriteByte(' ')
+		b.WriteByte('"')
+		b.WriteRune(annoMarker)
+		b.WriteString(base64.StdEncoding.EncodeToString([]byte(inner)))
+		b.WriteByte('"')
+		i += j + 1
 	}
-	label(v.Child, pre)
-	label(v.Sib, pre)
-	v.Label = pre + strconv.Itoa(v.Id)
+	return b.String(), nil
 }
-func writeTree(v *Node, w *bytes.Buffer) {
-	if v == nil {
+
+// applyAnnotation attaches a bracketed annotation, decoded by
+// extractBracketed's counterpart in parseTree, to v: an NHX annotation
+// populates v.Meta, anything else is kept verbatim in v.Comment.
+func applyAnnotation(v *Node, raw string) {
+	if strings.HasPrefix(raw, "&&NHX:") {
+		for _, kv := range strings.Split(strings.TrimPrefix(raw, "&&NHX:"), ":") {
+			if kv == "" {
+				continue
+			}
+			if eq := strings.IndexByte(kv, '='); eq != -1 {
+				v.SetMeta(kv[:eq], kv[eq+1:])
+			}
+		}
 		return
 	}
-	if v.Parent != nil && v.Parent.Child.Id != v.Id {
-		fmt.Fprint(w, ",")
+	v.Comment = raw
+}
+
+// walk implements the depth-first traversal behind (*Node).Walk. path
+// always has the node under consideration as its last element. It grows
+// and shrinks path's backing array in place across the whole traversal
+// rather than copying it per node, so a single walk over n nodes does
+// O(n) amortized appends instead of O(n * depth); see WalkHandler for the
+// resulting restriction on retaining a Path past its callback.
+func walk(ctx context.Context, path Path, h WalkHandler) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+	}
+	n := path.Node()
+	if h.PreNode != nil {
+		if err := h.PreNode(path); err != nil {
+			if err == SkipSubtree {
+				return nil
+			}
+			return err
+		}
 	}
-	if v.Child != nil {
-		fmt.Fprint(w, "(")
+	if n.Child == nil && h.Leaf != nil {
+		if err := h.Leaf(path); err != nil && err != SkipSubtree {
+			return err
+		}
 	}
-	writeTree(v.Child, w)
-	printLabel(w, v)
-	writeTree(v.Sib, w)
-	if v.Parent != nil && v.Sib == nil {
-		fmt.Fprint(w, ")")
+	for c := n.Child; c != nil; c = c.Sib {
+		path = append(path, c)
+		if h.Edge != nil {
+			if err := h.Edge(path); err != nil {
+				path = path[:len(path)-1]
+				if err == SkipSubtree {
+					continue
+				}
+				return err
+			}
+		}
+		if err := walk(ctx, path, h); err != nil {
+			return err
+		}
+		path = path[:len(path)-1]
 	}
-	if v.Parent == nil {
-		fmt.Fprint(w, ";")
+	if h.PostNode != nil {
+		if err := h.PostNode(path); err != nil && err != SkipSubtree {
+			return err
+		}
 	}
+	return nil
 }
 func printLabel(w *bytes.Buffer, v *Node) {
 	label := v.Label
@@ -288,38 +537,24 @@ func printLabel(w *bytes.Buffer, v *Node) {
 	if v.HasLength && v.Parent != nil {
 		fmt.Fprintf(w, ":%.3g", v.Length)
 	}
-}
-func show(v *Node, h int, b *bytes.Buffer) {
-	if v == nil {
-		return
-	}
-	show(v.Sib, h, b)
-	printNode(v.Label, h, b)
-	show(v.Child, h+1, b)
-}
-func printNode(l string, h int, b *bytes.Buffer) {
-	for i := 0; i < h; i++ {
-		fmt.Fprintf(b, "   ")
-	}
-	if len(l) == 0 {
-		l = "*"
-	}
-	fmt.Fprintf(b, "%s\n", l)
-}
-func collectLabels(v *Node, labels map[string]bool) {
-	if v == nil {
-		return
-	}
-	if v.Label != "" {
-		labels[v.Label] = true
+	if len(v.Meta) > 0 {
+		var tags []string
+		for k := range v.Meta {
+			tags = append(tags, k)
+		}
+		sort.Strings(tags)
+		for i, k := range tags {
+			tags[i] = k + "=" + v.Meta[k]
+		}
+		fmt.Fprintf(w, "[&&NHX:%s]", strings.Join(tags, ":"))
+	} else if v.Comment != "" {
+		fmt.Fprintf(w, "[%s]", v.Comment)
 	}
-	collectLabels(v.Child, labels)
-	collectLabels(v.Sib, labels)
 }
-
 //  NewScanner returns a scanner for scanning Newick-formatted  phylogenies.
 func NewScanner(r io.Reader) *Scanner {
 	sc := new(Scanner)
+	sc.AllowNHX = true
 	sc.r = bufio.NewReader(r)
 	return sc
 }
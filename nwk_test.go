@@ -1,7 +1,10 @@
 package nwk
 
 import (
+	"bytes"
+	"context"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -23,15 +26,15 @@ func TestNewick(t *testing.T) {
 				get, want)
 		}
 	}
-	root2 := root.CopyClade()
-	get := root2.String()
+	tree := NewTree(root)
+	get := tree.Root().String()
 	if get != want {
 		t.Errorf("get:\n%s\nwant\n%s\n", get, want)
 	}
 	root.UniformLabels("n")
-	want = `(((n13:0.2,n14:0.3)n12:0.3,` +
-		`(n16:0.5,n17:0.3)n15:0.2)n11` +
-		`:0.3,n18:0.7)n10;`
+	want = `(((n4:0.2,n5:0.3)n3:0.3,` +
+		`(n7:0.5,n8:0.3)n6:0.2)n2` +
+		`:0.3,n9:0.7)n1;`
 	get = root.String()
 	if get != want {
 		t.Errorf("get:\n%s\nwant:\n%s",
@@ -41,9 +44,9 @@ func TestNewick(t *testing.T) {
 	n2 := root.Child.Child.Sib.Child
 	l1 := n1.LCA(n2)
 	l2 := n2.LCA(n1)
-	if l1.Id != l2.Id || l1.Id != 11 {
+	if l1.Id != l2.Id || l1.Id != 2 {
 		t.Errorf("get:\n%d\nwant:\n%d",
-			l1.Id, 11)
+			l1.Id, 2)
 	}
 	ud := n1.UpDistance(root)
 	if ud != 0.8 {
@@ -54,9 +57,9 @@ func TestNewick(t *testing.T) {
 	root.AddChild(ch)
 	get = root.String()
 	ot := want
-	want = `(((n13:0.2,n14:0.3)n12:0.3,` +
-		`(n16:0.5,n17:0.3)n15:0.2)n11` +
-		`:0.3,n18:0.7,new)n10;`
+	want = `(((n4:0.2,n5:0.3)n3:0.3,` +
+		`(n7:0.5,n8:0.3)n6:0.2)n2` +
+		`:0.3,n9:0.7,new)n1;`
 	if get != want {
 		t.Errorf("get:\n%s\nwant:\n%s", get, want)
 	}
@@ -67,17 +70,45 @@ func TestNewick(t *testing.T) {
 		t.Errorf("get:\n%s\nwant:\n%s", get, want)
 	}
 	get = root.Print()
-	want = "n10\n   n18\n   n11\n      n15\n         n17\n" +
-		"         n16\n      n12\n         n14\n" +
-		"         n13\n"
+	want = "n1\n   n2\n      n3\n         n4\n" +
+		"         n5\n      n6\n         n7\n" +
+		"         n8\n   n9\n"
 	if get != want {
 		t.Errorf("get:\n%s\nwant:\n%s", get, want)
 	}
-	want = "n10$n11$n12$n13$n14$n15$n16$n17$n18"
+	want = "n1$n2$n3$n4$n5$n6$n7$n8$n9"
 	get = root.Key("$")
 	if get != want {
 		t.Errorf("get:\n%s\nwant:\n%s", get, want)
 	}
+	n := 0
+	err = root.Walk(context.Background(), WalkHandler{
+		PreNode: func(path Path) error {
+			n++
+			return nil
+		},
+	})
+	if err != nil {
+		t.Errorf("get:\n%v\nwant:\nnil", err)
+	}
+	if n != 9 {
+		t.Errorf("get:\n%d\nwant:\n%d", n, 9)
+	}
+	err = root.Walk(context.Background(), WalkHandler{
+		PreNode: func(path Path) error {
+			if path.Node().Id == root.Child.Id {
+				return SkipSubtree
+			}
+			return nil
+		},
+		Leaf: func(path Path) error {
+			n++
+			return nil
+		},
+	})
+	if err != nil {
+		t.Errorf("get:\n%v\nwant:\nnil", err)
+	}
 	in = "test2.nwk"
 	f, err = os.Open(in)
 	if err != nil {
@@ -87,22 +118,247 @@ func TestNewick(t *testing.T) {
 	sc = NewScanner(f)
 	sc.Scan()
 	origRoot := sc.Tree()
-	copyRoot := origRoot.CopyClade()
+	origTree := NewTree(origRoot)
 	want = `((T1:47)4:1,((T6:15,T7:11)5:20,` +
 		`((T8:34,T9:37)6:3,T10:41)7:2)8:4)9;`
-	v := copyRoot.Child.Child.Sib
-	v.RemoveClade()
-	get = copyRoot.String()
+	v := origRoot.Child.Child.Sib
+	txn := origTree.Txn()
+	if err := txn.RemoveClade(v); err != nil {
+		t.Errorf("get:\n%v\nwant:\nnil", err)
+	}
+	get = txn.Commit().Root().String()
 	if get != want {
 		t.Errorf("get\n%s\nwant:\n%s\n", get, want)
 	}
-	want = `((T1:47,(T5:31)3:10)4:1,((T6:15,T7:11)5:20,` +
+	want = `((T1:47,3:10)4:1,((T6:15,T7:11)5:20,` +
 		`((T8:34,T9:37)6:3,T10:41)7:2)8:4)9;`
-	copyRoot = origRoot.CopyClade()
-	v = copyRoot.Child.Child.Sib.Child
-	v.RemoveClade()
-	get = copyRoot.String()
+	v = origRoot.Child.Child.Sib.Child
+	txn = origTree.Txn()
+	if err := txn.RemoveClade(v); err != nil {
+		t.Errorf("get:\n%v\nwant:\nnil", err)
+	}
+	get = txn.Commit().Root().String()
 	if get != want {
 		t.Errorf("get:\n%s\nwant:\n%s\n", get, want)
 	}
+	if get2 := origTree.Root().String(); !strings.Contains(get2, "T5") {
+		t.Errorf("get:\n%s\nwant original tree untouched, still containing T5", get2)
+	}
+}
+
+// TestWalkSkipSubtree checks that SkipSubtree prunes from Edge the same
+// way it does from PreNode, and is a harmless no-op from Leaf and
+// PostNode, which have nothing left to prune.
+func TestWalkSkipSubtree(t *testing.T) {
+	sc := NewScanner(strings.NewReader("((A,B)X,(C,D)Y)root;"))
+	sc.Scan()
+	root := sc.Tree()
+	var visited []string
+	err := root.Walk(context.Background(), WalkHandler{
+		Edge: func(path Path) error {
+			if path.Node().Label == "X" {
+				return SkipSubtree
+			}
+			return nil
+		},
+		Leaf: func(path Path) error {
+			visited = append(visited, path.Node().Label)
+			return SkipSubtree
+		},
+		PostNode: func(path Path) error {
+			return SkipSubtree
+		},
+	})
+	if err != nil {
+		t.Errorf("get:\n%v\nwant:\nnil", err)
+	}
+	want := []string{"C", "D"}
+	if len(visited) != len(want) {
+		t.Fatalf("get:\n%v\nwant:\n%v", visited, want)
+	}
+	for i := range want {
+		if visited[i] != want[i] {
+			t.Errorf("get:\n%v\nwant:\n%v", visited, want)
+		}
+	}
+}
+
+func TestDOT(t *testing.T) {
+	in := "test1.nwk"
+	f, err := os.Open(in)
+	if err != nil {
+		t.Errorf("couldn't open %q", in)
+	}
+	defer f.Close()
+	sc := NewScanner(f)
+	sc.Scan()
+	root := sc.Tree()
+	var buf bytes.Buffer
+	opts := &DOTOptions{ShowLengths: true}
+	err = root.DOT(&buf, opts)
+	if err != nil {
+		t.Errorf("get:\n%v\nwant:\nnil", err)
+	}
+	get := buf.String()
+	for _, want := range []string{"digraph nwk {", "label=\"0.2\"", "}\n"} {
+		if !strings.Contains(get, want) {
+			t.Errorf("get:\n%s\ndoesn't contain:\n%s", get, want)
+		}
+	}
+}
+
+// TestRenderSVGFallbackEscapesLabels guards against raw "<", ">" and "&" in
+// a label breaking the SVG markup emitted by renderSVGFallback.
+func TestRenderSVGFallbackEscapesLabels(t *testing.T) {
+	sc := NewScanner(strings.NewReader(`('A<x>&y');`))
+	sc.Scan()
+	root := sc.Tree()
+	var buf bytes.Buffer
+	if err := root.renderSVGFallback(&buf); err != nil {
+		t.Errorf("get:\n%v\nwant:\nnil", err)
+	}
+	get := buf.String()
+	if strings.Contains(get, "<x>") || strings.Contains(get, "&y<") {
+		t.Errorf("get:\n%s\nwant: label escaped, no raw <x> or &y", get)
+	}
+	if !strings.Contains(get, "A&lt;x&gt;&amp;y") {
+		t.Errorf("get:\n%s\nwant it to contain the escaped label A&lt;x&gt;&amp;y", get)
+	}
+}
+
+func TestNHX(t *testing.T) {
+	in := "(A[&&NHX:S=human:B=97],B[&&NHX:S=chimp])root[&&NHX:D=N];"
+	sc := NewScanner(strings.NewReader(in))
+	sc.Scan()
+	root := sc.Tree()
+	if err := sc.Err(); err != nil {
+		t.Errorf("get:\n%v\nwant:\nnil", err)
+	}
+	a := root.Child
+	if v, ok := a.GetMeta("S"); !ok || v != "human" {
+		t.Errorf("get:\n%s,%v\nwant:\nhuman,true", v, ok)
+	}
+	if v, _ := root.GetMeta("D"); v != "N" {
+		t.Errorf("get:\n%s\nwant:\nN", v)
+	}
+	get := root.String()
+	want := `(A[&&NHX:B=97:S=human],B[&&NHX:S=chimp])root[&&NHX:D=N];`
+	if get != want {
+		t.Errorf("get:\n%s\nwant:\n%s", get, want)
+	}
+	sc2 := NewScanner(strings.NewReader("(A[&&NHX:S=human]);"))
+	sc2.AllowNHX = false
+	sc2.Scan()
+	sc2.Tree()
+	if sc2.Err() == nil {
+		t.Errorf("get:\nnil\nwant:\nerror")
+	}
+}
+
+// buildBalancedTree returns a new tree with roughly the given number of
+// leaves, for use in TestTree and BenchmarkTxnPrune.
+func buildBalancedTree(leaves int) *Node {
+	root := NewNode()
+	if leaves <= 1 {
+		return root
+	}
+	mid := leaves / 2
+	root.AddChild(buildBalancedTree(mid))
+	root.AddChild(buildBalancedTree(leaves - mid))
+	return root
+}
+
+func TestTree(t *testing.T) {
+	orig := NewTree(buildBalancedTree(8))
+	origFirstChild := orig.Root().Child
+	txn := orig.Txn()
+	var touched []*Node
+	txn.Notify(func(n *Node) { touched = append(touched, n) })
+	if err := txn.RemoveClade(origFirstChild); err != nil {
+		t.Errorf("get:\n%v\nwant:\nnil", err)
+	}
+	next := txn.Commit()
+	if len(touched) == 0 {
+		t.Errorf("get:\n0\nwant:\nmore than 0 changed nodes")
+	}
+	if next.Root() == orig.Root() {
+		t.Errorf("get:\nsame root\nwant:\na new root")
+	}
+	if next.Root().Child == origFirstChild {
+		t.Errorf("get:\nremoved child still attached\nwant:\nit gone")
+	}
+	if orig.Root().Child != origFirstChild {
+		t.Errorf("get:\noriginal tree mutated\nwant:\nit untouched")
+	}
+}
+
+// TestTxnAddChild guards against AddChild relinking an already-attached
+// node in place instead of copying it, which would silently corrupt
+// whatever Tree that node came from.
+func TestTxnAddChild(t *testing.T) {
+	sc := NewScanner(strings.NewReader("((A,B)X,(C,D)Y)root;"))
+	sc.Scan()
+	root := sc.Tree()
+	orig := NewTree(root)
+	want := orig.Root().String()
+	nodeA := root.Child.Child
+	y := root.Child.Sib
+	txn := orig.Txn()
+	txn.AddChild(y, nodeA)
+	txn.Commit()
+	if get := orig.Root().String(); get != want {
+		t.Errorf("get:\n%s\nwant:\n%s\n", get, want)
+	}
+}
+
+// BenchmarkTxnPrune measures the cost of repeatedly pruning the same leaf
+// off a 10k-leaf tree through a fresh Txn each time, which should be
+// O(depth) per iteration rather than O(n). This tree snapshot doesn't have
+// CopyClade, so there's no direct before/after comparison benchmark here.
+func BenchmarkTxnPrune(b *testing.B) {
+	tree := NewTree(buildBalancedTree(10000))
+	leaf := tree.Root()
+	for leaf.Child != nil {
+		leaf = leaf.Child
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		txn := tree.Txn()
+		txn.RemoveClade(leaf)
+		txn.Commit()
+	}
+}
+
+func TestReader(t *testing.T) {
+	in := "(A:1,B:2);\n(C:3,D:4);\n(E:5,F:6);\n"
+	r := NewReader(strings.NewReader(in))
+	r.N = 3
+	var got []string
+	err := r.Read(context.Background(), func(rc RCtx) error {
+		if rc.Index != len(got) {
+			t.Errorf("get:\n%d\nwant:\n%d", rc.Index, len(got))
+		}
+		got = append(got, rc.Root.String())
+		return nil
+	})
+	if err != nil {
+		t.Errorf("get:\n%v\nwant:\nnil", err)
+	}
+	want := []string{"(A:1,B:2);", "(C:3,D:4);", "(E:5,F:6);"}
+	if len(got) != len(want) {
+		t.Fatalf("get:\n%v\nwant:\n%v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("get:\n%s\nwant:\n%s", got[i], want[i])
+		}
+	}
+	bad := NewReader(strings.NewReader("(A:x,B:2);"))
+	err = bad.Read(context.Background(), func(rc RCtx) error { return nil })
+	if err == nil {
+		t.Errorf("get:\nnil\nwant:\nerror")
+	}
+	if _, ok := err.(*ParseError); !ok {
+		t.Errorf("get:\n%T\nwant:\n*ParseError", err)
+	}
 }
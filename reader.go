@@ -0,0 +1,143 @@
+package nwk
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"strings"
+	"sync"
+)
+
+// RCtx is delivered to the callback passed to Reader.Read for every tree
+// read from the input.
+type RCtx struct {
+	// Index is the ordinal position of this tree in the input, starting
+	// at 0.
+	Index int
+	// Offset is the byte offset of the tree's first character in the
+	// input.
+	Offset int64
+	// Root is the parsed tree. It is nil if the tree couldn't be parsed;
+	// Read returns the parse error before the callback sees such an
+	// RCtx.
+	Root *Node
+}
+
+// A Reader parses a stream of semicolon-terminated Newick trees across a
+// pool of worker goroutines, for pipelines processing thousands of trees
+// (e.g. bootstrap replicates) where Scanner's one-tree-at-a-time API
+// doesn't fit.
+type Reader struct {
+	r io.Reader
+	// N is the number of worker goroutines Read uses to parse trees. Left
+	// at its zero value, Read treats it as 1.
+	N int
+	// AllowNHX is forwarded to every tree parsed from the stream; see
+	// Scanner.AllowNHX.
+	AllowNHX bool
+}
+
+// NewReader returns a Reader that parses trees from r, with NHX
+// annotations allowed by default.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: r, N: 1, AllowNHX: true}
+}
+
+type readerJob struct {
+	index  int
+	offset int64
+	text   string
+}
+
+type readerResult struct {
+	ctx RCtx
+	err error
+}
+
+// Read scans trees out of the Reader's input and parses them across N
+// worker goroutines, then calls fn once per tree, in input order, with an
+// RCtx describing it. It stops as soon as fn or the parser returns an
+// error, and returns that error; it also honors ctx's cancellation. A parse
+// error is returned to the caller, as Scanner.Err reports it.
+func (r *Reader) Read(ctx context.Context, fn func(RCtx) error) error {
+	n := r.N
+	if n < 1 {
+		n = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	jobs := make(chan readerJob)
+	results := make(chan readerResult)
+
+	var workers sync.WaitGroup
+	workers.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer workers.Done()
+			for j := range jobs {
+				root, err := parseTree(j.text, r.AllowNHX)
+				res := readerResult{ctx: RCtx{Index: j.index, Offset: j.offset, Root: root}, err: err}
+				select {
+				case results <- res:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+	go r.produce(ctx, jobs)
+
+	pending := make(map[int]readerResult)
+	next := 0
+	for res := range results {
+		pending[res.ctx.Index] = res
+		for {
+			rc, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if rc.err != nil {
+				cancel()
+				return rc.err
+			}
+			if err := fn(rc.ctx); err != nil {
+				cancel()
+				return err
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+// produce reads semicolon-terminated trees off r.r and feeds them to jobs
+// until the input is exhausted or ctx is done, and then closes jobs.
+func (r *Reader) produce(ctx context.Context, jobs chan<- readerJob) {
+	defer close(jobs)
+	br := bufio.NewReader(r.r)
+	var offset int64
+	index := 0
+	for {
+		text, err := br.ReadString(';')
+		if err != nil {
+			// Mirrors Scanner.Scan: a read that doesn't end in a ';'
+			// before running into an error (typically trailing
+			// whitespace before EOF) isn't a tree, so it's discarded.
+			return
+		}
+		lead := len(text) - len(strings.TrimLeft(text, " \t\r\n"))
+		select {
+		case jobs <- readerJob{index: index, offset: offset + int64(lead), text: text}:
+			offset += int64(len(text))
+			index++
+		case <-ctx.Done():
+			return
+		}
+	}
+}
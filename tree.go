@@ -0,0 +1,190 @@
+package nwk
+
+import "errors"
+
+// A Tree is an immutable wrapper around the root of a Node tree. Structural
+// edits go through a Txn, which applies them by copying only the nodes on
+// the path from the root to the edit site (and, at each level along that
+// path, the direct siblings whose Sib pointers need rebuilding) — every
+// other subtree is shared, unmodified, with the original Tree.
+//
+// Because Node still carries a Parent pointer, that sharing isn't perfect:
+// a node deep inside an untouched subtree keeps pointing at the ancestor
+// chain of the Tree it was copied from, not the new one. Methods that walk
+// upward from a node (LCA, UpDistance) should be used against the Tree
+// that node was read from, not a Tree produced by a later Txn.
+type Tree struct {
+	root *Node
+}
+
+// NewTree wraps root in an immutable Tree.
+func NewTree(root *Node) *Tree {
+	return &Tree{root: root}
+}
+
+// Root returns the tree's root node. The returned subtree must not be
+// mutated in place; go through a Txn instead.
+func (t *Tree) Root() *Node {
+	return t.root
+}
+
+// Txn starts a transaction against t. Call one or more edit methods, then
+// Commit to obtain the resulting Tree. A Txn applies each edit against the
+// root-to-site path as it stood when the edit method was called, so edits
+// on overlapping subtrees within the same Txn don't compose; start a fresh
+// Txn per edit in that case.
+func (t *Tree) Txn() *Txn {
+	return &Txn{root: t.root}
+}
+
+// A Txn is a transaction against a Tree, as returned by Tree.Txn.
+type Txn struct {
+	root     *Node
+	watchers []func(*Node)
+	changed  []*Node
+}
+
+// Notify registers fn to be called, once Commit runs, with every node
+// whose subtree was recreated by this transaction's edits.
+func (x *Txn) Notify(fn func(n *Node)) {
+	x.watchers = append(x.watchers, fn)
+}
+
+// Commit runs any registered Notify hooks over the nodes changed by this
+// transaction's edits, and returns the resulting, immutable Tree.
+func (x *Txn) Commit() *Tree {
+	for _, fn := range x.watchers {
+		for _, n := range x.changed {
+			fn(n)
+		}
+	}
+	return &Tree{root: x.root}
+}
+
+// AddChild adds child as a new last child of parent, copying parent and
+// every ancestor up to the transaction's root, plus child itself, so that
+// child can safely be a node that's already attached elsewhere (another
+// Tree, or the same Tree in a different Txn) without that original being
+// mutated; child's own subtree, and every subtree already attached to
+// parent, are shared with the original Tree.
+func (x *Txn) AddChild(parent, child *Node) {
+	newParent := x.spliceAddChild(parent, child)
+	x.root = x.replacePath(parent, newParent)
+}
+
+// RemoveChild removes child from parent's children, copying parent and
+// every ancestor up to the transaction's root. It returns an error if
+// child isn't a direct child of parent.
+func (x *Txn) RemoveChild(parent, child *Node) error {
+	found := false
+	for c := parent.Child; c != nil; c = c.Sib {
+		if c.Id == child.Id {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return errors.New("child not found")
+	}
+	newParent := x.spliceChild(parent, child, nil)
+	x.root = x.replacePath(parent, newParent)
+	return nil
+}
+
+// RemoveClade removes the clade rooted on v from its parent; it is a
+// convenience wrapper around RemoveChild.
+func (x *Txn) RemoveClade(v *Node) error {
+	if v.Parent == nil {
+		return errors.New("can't remove the root")
+	}
+	return x.RemoveChild(v.Parent, v)
+}
+
+// spliceAddChild returns a copy of parent with every existing child
+// shallow-copied (their Sib pointers must be rebuilt) and a shallow copy
+// of newChild appended after them, so that relinking it doesn't mutate
+// the original newChild in place.
+func (x *Txn) spliceAddChild(parent, newChild *Node) *Node {
+	np := shallowCopy(parent)
+	np.Child = nil
+	var tail *Node
+	for c := parent.Child; c != nil; c = c.Sib {
+		nc := shallowCopy(c)
+		nc.Parent, nc.Sib = np, nil
+		if tail == nil {
+			np.Child = nc
+		} else {
+			tail.Sib = nc
+		}
+		tail = nc
+		x.changed = append(x.changed, nc)
+	}
+	nc := shallowCopy(newChild)
+	nc.Parent, nc.Sib = np, nil
+	if tail == nil {
+		np.Child = nc
+	} else {
+		tail.Sib = nc
+	}
+	x.changed = append(x.changed, np)
+	return np
+}
+
+// spliceChild returns a copy of parent whose child list has target
+// replaced by replacement, or removed if replacement is nil. Every other
+// direct child is shallow-copied too, since its Sib pointer must be
+// rebuilt, but the subtrees below that level are shared with the
+// original.
+func (x *Txn) spliceChild(parent, target, replacement *Node) *Node {
+	np := shallowCopy(parent)
+	np.Child = nil
+	var tail *Node
+	for c := parent.Child; c != nil; c = c.Sib {
+		var nc *Node
+		switch {
+		case c.Id == target.Id && replacement == nil:
+			continue
+		case c.Id == target.Id:
+			nc = replacement
+		default:
+			nc = shallowCopy(c)
+		}
+		nc.Parent, nc.Sib = np, nil
+		if tail == nil {
+			np.Child = nc
+		} else {
+			tail.Sib = nc
+		}
+		tail = nc
+		x.changed = append(x.changed, nc)
+	}
+	x.changed = append(x.changed, np)
+	return np
+}
+
+// replacePath copies every node from old up to the transaction's root,
+// substituting replacement for old at the bottom of the chain, and
+// returns the new root.
+func (x *Txn) replacePath(old, replacement *Node) *Node {
+	if old.Parent == nil {
+		return replacement
+	}
+	parent := old.Parent
+	newParent := x.spliceChild(parent, old, replacement)
+	return x.replacePath(parent, newParent)
+}
+
+// shallowCopy copies a node's own fields, not its children or siblings. Its
+// Meta map is cloned rather than shared, so that SetMeta on the copy can't
+// reach back and mutate the original node it was copied from.
+func shallowCopy(n *Node) *Node {
+	c := new(Node)
+	*c = *n
+	if n.Meta != nil {
+		c.Meta = make(map[string]string, len(n.Meta))
+		for k, v := range n.Meta {
+			c.Meta[k] = v
+		}
+	}
+	return c
+}